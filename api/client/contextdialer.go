@@ -17,14 +17,96 @@ limitations under the License.
 package client
 
 import (
+	"bufio"
 	"context"
+	"encoding/base64"
 	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gravitational/trace"
 	"golang.org/x/crypto/ssh"
+	xproxy "golang.org/x/net/proxy"
 )
 
+func init() {
+	// x/net/proxy only registers a dialer for the socks5/socks5h schemes
+	// out of the box; register http/https so that xproxy.FromURL can
+	// also route connections through a plain HTTP CONNECT proxy, which is
+	// what HTTPS_PROXY/ALL_PROXY point to in the overwhelming majority of
+	// corporate environments.
+	xproxy.RegisterDialerType("http", newHTTPConnectProxy)
+	xproxy.RegisterDialerType("https", newHTTPConnectProxy)
+}
+
+// newHTTPConnectProxy satisfies the xproxy.RegisterDialerType signature and
+// builds a Dialer that tunnels through proxyURL using HTTP CONNECT.
+func newHTTPConnectProxy(proxyURL *url.URL, forward xproxy.Dialer) (xproxy.Dialer, error) {
+	return &httpConnectDialer{proxyURL: proxyURL, forward: forward}, nil
+}
+
+// httpConnectDialer dials through an HTTP(S) proxy using the CONNECT
+// method, as used by HTTPS_PROXY/ALL_PROXY in the vast majority of
+// corporate and CI environments. The connection to the proxy itself is
+// plain TCP for https:// proxy URLs too; it is not wrapped in TLS.
+type httpConnectDialer struct {
+	proxyURL *url.URL
+	forward  xproxy.Dialer
+}
+
+// Dial implements xproxy.Dialer.
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext implements xproxy.ContextDialer.
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if cd, ok := d.forward.(xproxy.ContextDialer); ok {
+		conn, err = cd.DialContext(ctx, network, d.proxyURL.Host)
+	} else {
+		conn, err = d.forward.Dial(network, d.proxyURL.Host)
+	}
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	connectReq := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := d.proxyURL.User; user != nil {
+		password, _ := user.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		connectReq.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := connectReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, trace.Wrap(err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), connectReq)
+	if err != nil {
+		conn.Close()
+		return nil, trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, trace.BadParameter("proxy CONNECT to %v failed: %v", addr, resp.Status)
+	}
+	return conn, nil
+}
+
 // ContextDialer represents network dialer interface that uses context
 type ContextDialer interface {
 	// DialContext is a function that dials the specified address
@@ -39,89 +121,636 @@ func (f ContextDialerFunc) DialContext(ctx context.Context, network, addr string
 	return f(ctx, network, addr)
 }
 
-// NewAddrDialer makes a new dialer from a list of addresses
-func NewAddrDialer(addrs []string, keepAliveInterval, dialTimeout time.Duration) (ContextDialer, error) {
+// ProxyFunc returns the URL of the outbound proxy to use to reach addr, or a
+// nil URL if addr should be dialed directly.
+type ProxyFunc func(ctx context.Context, addr string) (*url.URL, error)
+
+// DialerOption configures the proxying behavior shared by the dialers in
+// this file.
+type DialerOption func(*dialerOptions)
+
+// dialerOptions holds the options configured via DialerOption.
+type dialerOptions struct {
+	proxyFunc ProxyFunc
+	strategy  DialStrategy
+}
+
+// DialStrategy controls how a dialer attempts to connect when it is given
+// more than one candidate address.
+type DialStrategy int
+
+const (
+	// Sequential dials each candidate address in order, moving on to the
+	// next only once the previous attempt has failed. This is the
+	// default, and matches the historical behavior of these dialers.
+	Sequential DialStrategy = iota
+	// Parallel dials every candidate address at once and returns the
+	// first one to succeed, cancelling the rest.
+	Parallel
+	// HappyEyeballs dials candidate addresses concurrently with a
+	// staggered start (RFC 8305), returning the first one to succeed and
+	// cancelling the rest.
+	HappyEyeballs
+)
+
+// happyEyeballsDelay is the delay between launching successive connection
+// attempts under the HappyEyeballs strategy.
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// WithDialStrategy sets the strategy used to dial multiple candidate
+// addresses. The default is Sequential.
+func WithDialStrategy(s DialStrategy) DialerOption {
+	return func(o *dialerOptions) {
+		o.strategy = s
+	}
+}
+
+// WithProxyURL forces the dialers to route every connection through
+// proxyURL (a "socks5://" or "http://" URL), bypassing the standard
+// HTTPS_PROXY/ALL_PROXY/NO_PROXY environment variables.
+func WithProxyURL(proxyURL *url.URL) DialerOption {
+	return func(o *dialerOptions) {
+		o.proxyFunc = func(_ context.Context, _ string) (*url.URL, error) {
+			return proxyURL, nil
+		}
+	}
+}
+
+// WithProxyFunc overrides the function used to resolve the outbound proxy
+// for a given dial target.
+func WithProxyFunc(fn ProxyFunc) DialerOption {
+	return func(o *dialerOptions) {
+		o.proxyFunc = fn
+	}
+}
+
+// buildDialerOptions applies opts on top of the default dialerOptions, which
+// resolve the proxy from the environment.
+func buildDialerOptions(opts ...DialerOption) *dialerOptions {
+	o := &dialerOptions{proxyFunc: proxyFromEnvironment}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// proxyFromEnvironment resolves the proxy to use to reach addr from the
+// standard HTTPS_PROXY, ALL_PROXY and NO_PROXY environment variables (and
+// their lowercase forms, per the curl/libcurl convention), matching the
+// semantics of golang.org/x/net/proxy.FromEnvironment.
+func proxyFromEnvironment(_ context.Context, addr string) (*url.URL, error) {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	if bypassProxy(host) {
+		return nil, nil
+	}
+	proxyAddr := firstEnv("ALL_PROXY", "all_proxy")
+	if proxyAddr == "" {
+		proxyAddr = firstEnv("HTTPS_PROXY", "https_proxy")
+	}
+	if proxyAddr == "" {
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(proxyAddr)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return proxyURL, nil
+}
+
+// firstEnv returns the value of the first of names that is set and
+// non-empty.
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// bypassProxy reports whether host matches an entry of the NO_PROXY
+// environment variable (or its lowercase form, no_proxy) and should
+// therefore be dialed directly instead of through the proxy.
+func bypassProxy(host string) bool {
+	noProxy := firstEnv("NO_PROXY", "no_proxy")
+	if noProxy == "" {
+		return false
+	}
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+			continue
+		case entry == "*":
+			return true
+		case host == entry:
+			return true
+		case strings.HasSuffix(host, "."+strings.TrimPrefix(entry, ".")):
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	unixSchemePrefix         = "unix:"
+	unixSchemeSlashesPrefix  = "unix://"
+	unixAbstractSchemePrefix = "unix-abstract:"
+)
+
+// isUnixAddr reports whether addr uses the unix:, unix:// or
+// unix-abstract: scheme recognized by the dialers in this file.
+func isUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, unixSchemePrefix) || strings.HasPrefix(addr, unixAbstractSchemePrefix)
+}
+
+// parseUnixAddr strips the unix:, unix:// or unix-abstract: scheme from addr
+// and returns the "unix" network together with the socket path to dial,
+// using Linux's abstract namespace for unix-abstract: addresses. Go's net
+// package treats a leading '@' as the abstract-namespace marker, converting
+// it to a leading NUL and dropping the usual trailing NUL it otherwise adds
+// to fixed-length sockaddr_un names.
+func parseUnixAddr(addr string) (network, path string, err error) {
+	switch {
+	case strings.HasPrefix(addr, unixAbstractSchemePrefix):
+		path = strings.TrimPrefix(addr, unixAbstractSchemePrefix)
+		if path == "" {
+			return "", "", trace.BadParameter("unix-abstract address %q is missing a socket name", addr)
+		}
+		return "unix", "@" + path, nil
+	case strings.HasPrefix(addr, unixSchemeSlashesPrefix):
+		path = strings.TrimPrefix(addr, unixSchemeSlashesPrefix)
+	case strings.HasPrefix(addr, unixSchemePrefix):
+		path = strings.TrimPrefix(addr, unixSchemePrefix)
+	default:
+		return "", "", trace.BadParameter("%q is not a unix socket address", addr)
+	}
+	if path == "" {
+		return "", "", trace.BadParameter("unix address %q is missing a socket path", addr)
+	}
+	return "unix", path, nil
+}
+
+// dialDirectOrProxy dials addr with forward, routing through the proxy
+// returned by o.proxyFunc when one applies to addr. Addresses using the
+// unix:, unix:// or unix-abstract: scheme are dialed as Unix domain
+// sockets and never go through a proxy.
+func dialDirectOrProxy(ctx context.Context, forward *net.Dialer, o *dialerOptions, network, addr string) (net.Conn, error) {
+	if isUnixAddr(addr) {
+		unixNetwork, unixPath, err := parseUnixAddr(addr)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		return forward.DialContext(ctx, unixNetwork, unixPath)
+	}
+	proxyURL, err := o.proxyFunc(ctx, addr)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if proxyURL == nil {
+		return forward.DialContext(ctx, network, addr)
+	}
+	d, err := xproxy.FromURL(proxyURL, forward)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if cd, ok := d.(xproxy.ContextDialer); ok {
+		return cd.DialContext(ctx, network, addr)
+	}
+	return d.Dial(network, addr)
+}
+
+// dialResult is the outcome of a single candidate dial attempt.
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialCandidates dials addrs according to o.strategy, calling dial once per
+// address, and returns the first successful connection. Errors from every
+// failed attempt are combined with trace.NewAggregate.
+func dialCandidates(ctx context.Context, addrs []string, o *dialerOptions, dial func(ctx context.Context, addr string) (net.Conn, error)) (net.Conn, error) {
 	if len(addrs) == 0 {
 		return nil, trace.BadParameter("no addreses to dial")
 	}
-	dialer := net.Dialer{
-		Timeout:   dialTimeout,
-		KeepAlive: keepAliveInterval,
-	}
-	return ContextDialerFunc(func(ctx context.Context, network, _ string) (conn net.Conn, err error) {
+	if o.strategy == Sequential {
+		var errs []error
 		for _, addr := range addrs {
-			conn, err = dialer.DialContext(ctx, network, addr)
+			conn, err := dial(ctx, addr)
 			if err == nil {
 				return conn, nil
 			}
+			errs = append(errs, err)
+		}
+		return nil, trace.NewAggregate(errs...)
+	}
+	return dialConcurrent(ctx, addrs, o.strategy, dial)
+}
+
+// dialConcurrent dials addrs in parallel, staggering launches by
+// happyEyeballsDelay under the HappyEyeballs strategy, and returns the
+// first successful connection, cancelling the remaining attempts.
+func dialConcurrent(ctx context.Context, addrs []string, strategy DialStrategy, dial func(ctx context.Context, addr string) (net.Conn, error)) (net.Conn, error) {
+	if len(addrs) == 0 {
+		return nil, trace.BadParameter("no addreses to dial")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(addrs))
+	for i, addr := range addrs {
+		i, addr := i, addr
+		go func() {
+			if strategy == HappyEyeballs && i > 0 {
+				timer := time.NewTimer(time.Duration(i) * happyEyeballsDelay)
+				defer timer.Stop()
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					results <- dialResult{err: ctx.Err()}
+					return
+				}
+			}
+			conn, err := dial(ctx, addr)
+			results <- dialResult{conn: conn, err: err}
+		}()
+	}
+
+	var errs []error
+	for i := range addrs {
+		res := <-results
+		if res.err == nil {
+			cancel()
+			// Other goroutines may already be mid-dial and will still
+			// send their result on results once we return; drain them in
+			// the background and close any connection that wins the race
+			// after us, per RFC 8305.
+			go drainDialResults(results, len(addrs)-i-1)
+			return res.conn, nil
+		}
+		errs = append(errs, res.err)
+	}
+	return nil, trace.NewAggregate(errs...)
+}
+
+// drainDialResults reads the remaining n results off results and closes any
+// connections among them, so that winners of a cancelled race don't leak.
+func drainDialResults(results <-chan dialResult, n int) {
+	for i := 0; i < n; i++ {
+		if res := <-results; res.conn != nil {
+			res.conn.Close()
+		}
+	}
+}
+
+// Endpoint is a single candidate dial target resolved by a Resolver.
+type Endpoint struct {
+	// Addr is the network address to dial, e.g. "proxy.example.com:3080",
+	// or a unix:, unix:// or unix-abstract: address.
+	Addr string
+}
+
+// Resolver resolves the current set of candidate addresses for a dialer.
+// Implementations may return a static list, query DNS, or anything else
+// that produces a set of endpoints to try.
+type Resolver interface {
+	// Resolve returns the current set of endpoints to dial.
+	Resolve(ctx context.Context) ([]Endpoint, error)
+}
+
+// WatchableResolver is a Resolver that can additionally push updates as its
+// resolved endpoints change, for future balancer-aware callers.
+type WatchableResolver interface {
+	Resolver
+	// Watch returns a channel of endpoint sets, updated as they change.
+	// The channel is closed when ctx is done.
+	Watch(ctx context.Context) <-chan []Endpoint
+}
+
+// staticResolver is a Resolver over a fixed list of addresses.
+type staticResolver struct {
+	endpoints []Endpoint
+}
+
+// NewStaticResolver returns a Resolver that always resolves to addrs.
+func NewStaticResolver(addrs []string) Resolver {
+	endpoints := make([]Endpoint, len(addrs))
+	for i, addr := range addrs {
+		endpoints[i] = Endpoint{Addr: addr}
+	}
+	return &staticResolver{endpoints: endpoints}
+}
+
+func (r *staticResolver) Resolve(_ context.Context) ([]Endpoint, error) {
+	if len(r.endpoints) == 0 {
+		return nil, trace.BadParameter("no addreses to dial")
+	}
+	return r.endpoints, nil
+}
+
+// dnsSRVLookuper performs DNS SRV lookups. Satisfied by *net.Resolver.
+type dnsSRVLookuper interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNSResolver resolves endpoints from a DNS SRV record, e.g.
+// "_teleport-proxy._tcp.example.com".
+type DNSResolver struct {
+	// Name is the fully-qualified SRV record name to query.
+	Name string
+	// Lookuper performs the SRV lookup. Defaults to net.DefaultResolver.
+	Lookuper dnsSRVLookuper
+}
+
+// Resolve looks up r.Name's SRV record and returns one endpoint per target,
+// in the order returned by the resolver (by priority, then weight).
+func (r *DNSResolver) Resolve(ctx context.Context) ([]Endpoint, error) {
+	lookuper := r.Lookuper
+	if lookuper == nil {
+		lookuper = net.DefaultResolver
+	}
+	_, srvs, err := lookuper.LookupSRV(ctx, "", "", r.Name)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if len(srvs) == 0 {
+		return nil, trace.NotFound("no SRV records found for %q", r.Name)
+	}
+	endpoints := make([]Endpoint, 0, len(srvs))
+	for _, srv := range srvs {
+		host := strings.TrimSuffix(srv.Target, ".")
+		endpoints = append(endpoints, Endpoint{Addr: net.JoinHostPort(host, strconv.Itoa(int(srv.Port)))})
+	}
+	return endpoints, nil
+}
+
+// CachingResolver wraps another Resolver, caching its result for TTL so
+// that repeated dials don't re-resolve on every attempt. If a refresh
+// fails, the last successful result is served instead.
+type CachingResolver struct {
+	// Resolver is the underlying Resolver to cache.
+	Resolver Resolver
+	// TTL is how long a resolution is served before it is refreshed.
+	TTL time.Duration
+
+	mu        sync.Mutex
+	endpoints []Endpoint
+	expiresAt time.Time
+}
+
+// defaultCachingResolverTTL is used by CachingResolver whenever TTL is
+// unset or non-positive, both to decide when Resolve's cache has gone
+// stale and as Watch's poll interval, since time.NewTicker panics on a
+// non-positive duration.
+const defaultCachingResolverTTL = time.Minute
+
+// ttl returns r.TTL, or defaultCachingResolverTTL if it is unset or
+// non-positive.
+func (r *CachingResolver) ttl() time.Duration {
+	if r.TTL <= 0 {
+		return defaultCachingResolverTTL
+	}
+	return r.TTL
+}
+
+// Resolve returns the cached endpoints, refreshing them from the
+// underlying Resolver once the cache has expired.
+func (r *CachingResolver) Resolve(ctx context.Context) ([]Endpoint, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.endpoints) > 0 && time.Now().Before(r.expiresAt) {
+		return r.endpoints, nil
+	}
+	endpoints, err := r.Resolver.Resolve(ctx)
+	if err != nil {
+		if len(r.endpoints) > 0 {
+			return r.endpoints, nil
+		}
+		return nil, trace.Wrap(err)
+	}
+	r.endpoints = endpoints
+	r.expiresAt = time.Now().Add(r.ttl())
+	return endpoints, nil
+}
+
+// Watch resolves endpoints once every TTL and sends the result on the
+// returned channel, implementing WatchableResolver.
+func (r *CachingResolver) Watch(ctx context.Context) <-chan []Endpoint {
+	ch := make(chan []Endpoint)
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(r.ttl())
+		defer ticker.Stop()
+		for {
+			if endpoints, err := r.Resolve(ctx); err == nil {
+				select {
+				case ch <- endpoints:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
 		}
-		// not wrapping on purpose to preserve the original error
-		return nil, err
+	}()
+	return ch
+}
+
+// rotateAddrs returns the addresses of endpoints rotated by n positions, so
+// that successive calls spread attempts across all endpoints instead of
+// always favoring the first one the resolver returned.
+func rotateAddrs(endpoints []Endpoint, n uint32) []string {
+	if len(endpoints) == 0 {
+		return nil
+	}
+	addrs := make([]string, len(endpoints))
+	offset := int(n % uint32(len(endpoints)))
+	for i := range addrs {
+		addrs[i] = endpoints[(offset+i)%len(endpoints)].Addr
+	}
+	return addrs
+}
+
+// resolveAndDial resolves endpoints from resolver, rotating across calls
+// via rotate, and dials them with dial. If every candidate from the first
+// resolution fails, it re-resolves once and retries, so that a resolver
+// backed by DNS or a balancer can fail over without restarting the client.
+func resolveAndDial(ctx context.Context, resolver Resolver, rotate *uint32, o *dialerOptions, dial func(ctx context.Context, addr string) (net.Conn, error)) (net.Conn, error) {
+	endpoints, err := resolver.Resolve(ctx)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if len(endpoints) == 0 {
+		return nil, trace.BadParameter("no addreses to dial")
+	}
+	addrs := rotateAddrs(endpoints, atomic.AddUint32(rotate, 1))
+	conn, dialErr := dialCandidates(ctx, addrs, o, dial)
+	if dialErr == nil {
+		return conn, nil
+	}
+	if endpoints, err = resolver.Resolve(ctx); err != nil || len(endpoints) == 0 {
+		return nil, dialErr
+	}
+	addrs = rotateAddrs(endpoints, atomic.AddUint32(rotate, 1))
+	return dialCandidates(ctx, addrs, o, dial)
+}
+
+// NewAddrDialer makes a new dialer from a Resolver of addresses
+func NewAddrDialer(resolver Resolver, keepAliveInterval, dialTimeout time.Duration, opts ...DialerOption) (ContextDialer, error) {
+	if resolver == nil {
+		return nil, trace.BadParameter("no resolver to dial")
+	}
+	dialer := net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: keepAliveInterval,
+	}
+	o := buildDialerOptions(opts...)
+	var rotate uint32
+	return ContextDialerFunc(func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return resolveAndDial(ctx, resolver, &rotate, o, func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialDirectOrProxy(ctx, &dialer, o, network, addr)
+		})
 	}), nil
 }
 
-func NewProxyDialer(addrs []string, keepAliveInterval, dialTimeout time.Duration, ssh *ssh.ClientConfig) (ContextDialer, error) {
+func NewProxyDialer(addrs []string, keepAliveInterval, dialTimeout time.Duration, ssh *ssh.ClientConfig, opts ...DialerOption) (ContextDialer, error) {
 	if len(addrs) == 0 {
 		return nil, trace.BadParameter("no addreses to dial")
 	}
 	if ssh == nil {
 		return nil, trace.BadParameter("no ssh config")
 	}
-	proxyDialer := &TunnelAuthDialer{
-		ClientConfig: ssh,
+	for _, addr := range addrs {
+		if isUnixAddr(addr) {
+			return nil, trace.BadParameter("cannot dial reverse tunnel proxy %q over a unix socket", addr)
+		}
 	}
-	return ContextDialerFunc(func(ctx context.Context, network, _ string) (conn net.Conn, err error) {
-		for _, addr := range addrs {
-			proxyDialer.ProxyAddr = addr
-			conn, err = proxyDialer.DialContext(ctx, network, addr)
-			if err == nil {
-				return conn, nil
+	forward := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: keepAliveInterval,
+	}
+	o := buildDialerOptions(opts...)
+	return ContextDialerFunc(func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return dialCandidates(ctx, addrs, o, func(ctx context.Context, addr string) (net.Conn, error) {
+			proxyDialer := &TunnelAuthDialer{
+				ProxyAddr:    addr,
+				ClientConfig: ssh,
+				Dialer: ContextDialerFunc(func(ctx context.Context, network, innerAddr string) (net.Conn, error) {
+					return dialDirectOrProxy(ctx, forward, o, network, innerAddr)
+				}),
 			}
-		}
-		return nil, err
+			return proxyDialer.DialContext(ctx, network, addr)
+		})
 	}), nil
 }
 
 // NewClientDialer makes a new dialer from a client Config. This dialer
-// will try dialing the address as both auth and proxy.
-func NewClientDialer(c *Client) (ContextDialer, error) {
-	if len(c.c.Addrs) == 0 {
-		return nil, trace.BadParameter("no addreses to dial")
+// dials unix:, unix:// and unix-abstract: addresses directly as an auth
+// server and every other address as a proxy, through its reverse tunnel;
+// no address is tried both ways. If resolver is nil,
+// it falls back to a static Resolver over the client's configured
+// addresses.
+func NewClientDialer(c *Client, resolver Resolver, opts ...DialerOption) (ContextDialer, error) {
+	if resolver == nil {
+		if len(c.c.Addrs) == 0 {
+			return nil, trace.BadParameter("no addreses to dial")
+		}
+		resolver = NewStaticResolver(c.c.Addrs)
 	}
-	return ContextDialerFunc(func(ctx context.Context, network, _ string) (conn net.Conn, err error) {
-		// authDialer := net.Dialer{
-		// 	Timeout:   c.DialTimeout,
-		// 	KeepAlive: c.KeepAlivePeriod,
-		// }
-		var errs []error
-		for _, addr := range c.c.Addrs {
-			// try dialing directly to auth server
-			// conn, err = authDialer.DialContext(ctx, network, addr)
-			// if err == nil {
-			// 	return conn, nil
-			// }
-			// errs = append(errs, trace.Errorf("failed to dial %v as auth: %v", addr, err))
-
-			// if connecting to auth fails and SSH is defined, try connecting via proxy
+	o := buildDialerOptions(opts...)
+	var rotate uint32
+	return ContextDialerFunc(func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return resolveAndDial(ctx, resolver, &rotate, o, func(ctx context.Context, addr string) (net.Conn, error) {
+			// A unix:, unix:// or unix-abstract: address is a colocated auth
+			// server (e.g. a sidecar, or tctl on the auth host): dial it
+			// directly and skip the SSH reverse tunnel entirely.
+			if isUnixAddr(addr) {
+				unixNetwork, unixPath, err := parseUnixAddr(addr)
+				if err != nil {
+					return nil, trace.Wrap(err)
+				}
+				return (&net.Dialer{}).DialContext(ctx, unixNetwork, unixPath)
+			}
 			if c.sshConfig == nil {
-				continue
+				return nil, trace.BadParameter("no ssh config to dial %v as proxy", addr)
 			}
-			// // Figure out the reverse tunnel address on the proxy first.
-			// tunAddr, err := findReverseTunnel(ctx, cfg.AuthServers, clientConfig.TLS.InsecureSkipVerify)
-			// if err != nil {
-			// 	errs = append(errs, trace.Wrap(err, "failed lookup of proxy reverse tunnel address: %v", err))
-			// 	return nil, trace.NewAggregate(errs...)
-			// // }
 			proxyDialer := &TunnelAuthDialer{
 				ProxyAddr:    addr,
 				ClientConfig: c.sshConfig,
+				Dialer: ContextDialerFunc(func(ctx context.Context, network, innerAddr string) (net.Conn, error) {
+					return dialDirectOrProxy(ctx, &net.Dialer{}, o, network, innerAddr)
+				}),
 			}
-			conn, err = proxyDialer.DialContext(ctx, network, addr)
-			if err == nil {
-				return conn, nil
-			}
-			errs = append(errs, trace.Errorf("failed to dial %v as proxy: %v", addr, err))
-		}
-		return nil, trace.NewAggregate(errs...)
+			return proxyDialer.DialContext(ctx, network, addr)
+		})
 	}), nil
 }
+
+// reverseTunnelAuthTarget is the SSH channel target used to reach the auth
+// server transparently through a proxy's reverse tunnel.
+const reverseTunnelAuthTarget = "@remote-auth-server:0"
+
+// TunnelAuthDialer dials the Teleport Auth Service through a proxy's reverse
+// tunnel, by opening an SSH connection to the proxy and requesting a direct
+// channel to the auth server.
+type TunnelAuthDialer struct {
+	// ProxyAddr is the address of the proxy's reverse tunnel port.
+	ProxyAddr string
+	// ClientConfig is the SSH config used to authenticate with the proxy.
+	ClientConfig *ssh.ClientConfig
+	// Dialer is used to establish the underlying network connection to
+	// ProxyAddr before the SSH handshake begins. When set to a
+	// proxy-aware dialer, this lets the tunnel connection itself be
+	// routed through a SOCKS5 or HTTP CONNECT proxy. If nil, a plain
+	// net.Dialer is used.
+	Dialer ContextDialer
+}
+
+// DialContext dials the auth server through the proxy's reverse tunnel.
+func (d *TunnelAuthDialer) DialContext(ctx context.Context, network, _ string) (net.Conn, error) {
+	dialer := d.Dialer
+	if dialer == nil {
+		dialer = ContextDialerFunc((&net.Dialer{}).DialContext)
+	}
+	conn, err := dialer.DialContext(ctx, network, d.ProxyAddr)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	sconn, chans, reqs, err := ssh.NewClientConn(conn, d.ProxyAddr, d.ClientConfig)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	client := ssh.NewClient(sconn, chans, reqs)
+	authConn, err := client.Dial(network, reverseTunnelAuthTarget)
+	if err != nil {
+		client.Close()
+		return nil, trace.Wrap(err)
+	}
+	return &tunnelConn{Conn: authConn, client: client}, nil
+}
+
+// tunnelConn is the auth channel opened over a TunnelAuthDialer's SSH
+// client. Closing it tears down the whole client — and with it the
+// client's goroutines and underlying TCP connection — rather than just the
+// channel, so that a losing candidate under concurrent dialing (see
+// dialConcurrent) doesn't leak its tunnel when the caller closes the conn.
+type tunnelConn struct {
+	net.Conn
+	client *ssh.Client
+}
+
+// Close closes both the auth channel and the ssh.Client that opened it.
+func (c *tunnelConn) Close() error {
+	channelErr := c.Conn.Close()
+	clientErr := c.client.Close()
+	if channelErr != nil {
+		return trace.Wrap(channelErr)
+	}
+	return trace.Wrap(clientErr)
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseUnixAddr(t *testing.T) {
+	tests := []struct {
+		name        string
+		addr        string
+		wantNetwork string
+		wantPath    string
+		wantErr     bool
+	}{
+		{name: "unix scheme", addr: "unix:/var/run/teleport.sock", wantNetwork: "unix", wantPath: "/var/run/teleport.sock"},
+		{name: "unix scheme with slashes", addr: "unix:///var/run/teleport.sock", wantNetwork: "unix", wantPath: "/var/run/teleport.sock"},
+		{name: "unix-abstract scheme", addr: "unix-abstract:teleport-auth", wantNetwork: "unix", wantPath: "@teleport-auth"},
+		{name: "unix scheme missing path", addr: "unix:", wantErr: true},
+		{name: "unix-abstract scheme missing name", addr: "unix-abstract:", wantErr: true},
+		{name: "not a unix address", addr: "tcp://127.0.0.1:3025", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network, path, err := parseUnixAddr(tt.addr)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseUnixAddr(%q): expected error, got none", tt.addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseUnixAddr(%q): unexpected error: %v", tt.addr, err)
+			}
+			if network != tt.wantNetwork || path != tt.wantPath {
+				t.Fatalf("parseUnixAddr(%q) = (%q, %q), want (%q, %q)", tt.addr, network, path, tt.wantNetwork, tt.wantPath)
+			}
+		})
+	}
+}
+
+func TestBypassProxy(t *testing.T) {
+	tests := []struct {
+		name    string
+		noProxy string
+		envVar  string
+		host    string
+		want    bool
+	}{
+		{name: "exact match", noProxy: "example.com,internal.example.com", envVar: "NO_PROXY", host: "example.com", want: true},
+		{name: "suffix match", noProxy: "example.com", envVar: "NO_PROXY", host: "auth.example.com", want: true},
+		{name: "no match", noProxy: "example.com", envVar: "NO_PROXY", host: "example.org", want: false},
+		{name: "wildcard", noProxy: "*", envVar: "NO_PROXY", host: "anything.example.org", want: true},
+		{name: "lowercase env var", noProxy: "example.com", envVar: "no_proxy", host: "example.com", want: true},
+		{name: "empty", noProxy: "", envVar: "NO_PROXY", host: "example.com", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("NO_PROXY", "")
+			t.Setenv("no_proxy", "")
+			t.Setenv(tt.envVar, tt.noProxy)
+			if got := bypassProxy(tt.host); got != tt.want {
+				t.Fatalf("bypassProxy(%q) with %s=%q = %v, want %v", tt.host, tt.envVar, tt.noProxy, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRotateAddrs(t *testing.T) {
+	endpoints := []Endpoint{{Addr: "a"}, {Addr: "b"}, {Addr: "c"}}
+
+	tests := []struct {
+		n    uint32
+		want []string
+	}{
+		{n: 0, want: []string{"a", "b", "c"}},
+		{n: 1, want: []string{"b", "c", "a"}},
+		{n: 2, want: []string{"c", "a", "b"}},
+		{n: 3, want: []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		got := rotateAddrs(endpoints, tt.n)
+		if len(got) != len(tt.want) {
+			t.Fatalf("rotateAddrs(_, %d) = %v, want %v", tt.n, got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Fatalf("rotateAddrs(_, %d) = %v, want %v", tt.n, got, tt.want)
+			}
+		}
+	}
+
+	if got := rotateAddrs(nil, 5); got != nil {
+		t.Fatalf("rotateAddrs(nil, 5) = %v, want nil", got)
+	}
+}
+
+// fakeConn is a minimal net.Conn that records whether it was closed.
+type fakeConn struct {
+	net.Conn
+	closed chan struct{}
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{closed: make(chan struct{})}
+}
+
+func (c *fakeConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestDialConcurrentReturnsWinnerAndClosesLosers(t *testing.T) {
+	winner := newFakeConn()
+	loser := newFakeConn()
+	started := make(chan string, 2)
+
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		started <- addr
+		switch addr {
+		case "winner":
+			return winner, nil
+		default:
+			// Give the winner a chance to be selected before this slow
+			// loser's connection is delivered. The dial completes even
+			// after ctx is cancelled, so the loser's connection arrives
+			// after the winner has been returned.
+			time.Sleep(50 * time.Millisecond)
+			return loser, nil
+		}
+	}
+
+	conn, err := dialConcurrent(context.Background(), []string{"winner", "loser"}, Parallel, dial)
+	if err != nil {
+		t.Fatalf("dialConcurrent: unexpected error: %v", err)
+	}
+	if conn != winner {
+		t.Fatalf("dialConcurrent returned %v, want the winner connection", conn)
+	}
+
+	select {
+	case <-loser.closed:
+	case <-time.After(time.Second):
+		t.Fatal("losing connection was never closed")
+	}
+}
+
+func TestDialConcurrentNoAddrs(t *testing.T) {
+	if _, err := dialConcurrent(context.Background(), nil, Parallel, func(ctx context.Context, addr string) (net.Conn, error) {
+		t.Fatal("dial should not be called with no addresses")
+		return nil, nil
+	}); err == nil {
+		t.Fatal("expected an error dialing zero addresses")
+	}
+}